@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deadlock
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Watchdog periodically pings every Pingable registered with it and reports how long
+	// each has been in flight to the supplied callback. It takes no position on what
+	// constitutes a hang; that decision, and any resulting metric emission, logging, or
+	// abort, is left to the caller's onPing callback.
+	Watchdog struct {
+		pingInterval time.Duration
+		onPing       func(name string, inFlight time.Duration)
+
+		mu      sync.Mutex
+		ops     map[string]Pingable
+		stopCh  chan struct{}
+		stopped bool
+	}
+)
+
+// NewWatchdog creates a Watchdog that calls onPing for every registered operation every
+// pingInterval. The watchdog's background goroutine is started immediately.
+func NewWatchdog(
+	pingInterval time.Duration,
+	onPing func(name string, inFlight time.Duration),
+) *Watchdog {
+
+	w := &Watchdog{
+		pingInterval: pingInterval,
+		onPing:       onPing,
+		ops:          make(map[string]Pingable),
+		stopCh:       make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Register adds op to the set of operations being watched under name. The returned
+// function must be called, typically via defer, once the operation completes.
+func (w *Watchdog) Register(name string, op Pingable) (deregister func()) {
+	w.mu.Lock()
+	w.ops[name] = op
+	w.mu.Unlock()
+
+	return func() {
+		w.mu.Lock()
+		delete(w.ops, name)
+		w.mu.Unlock()
+	}
+}
+
+// Stop terminates the watchdog's background goroutine. It is safe to call more than once.
+func (w *Watchdog) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stopped {
+		return
+	}
+	w.stopped = true
+	close(w.stopCh)
+}
+
+func (w *Watchdog) run() {
+	ticker := time.NewTicker(w.pingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			w.pingAll()
+		case <-w.stopCh:
+			return
+		}
+	}
+}
+
+func (w *Watchdog) pingAll() {
+	w.mu.Lock()
+	snapshot := make(map[string]Pingable, len(w.ops))
+	for name, op := range w.ops {
+		snapshot[name] = op
+	}
+	w.mu.Unlock()
+
+	for name, op := range snapshot {
+		w.onPing(name, op.Ping())
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package deadlock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type blockingOp struct {
+	startTime time.Time
+	unblockCh chan struct{}
+}
+
+func (o *blockingOp) Ping() time.Duration {
+	return time.Since(o.startTime)
+}
+
+func TestWatchdog_FiresOnHangingOperation(t *testing.T) {
+	op := &blockingOp{startTime: time.Now(), unblockCh: make(chan struct{})}
+
+	var mu sync.Mutex
+	pings := 0
+	watchdog := NewWatchdog(time.Millisecond, func(name string, inFlight time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		if name == "test-op" {
+			pings++
+		}
+	})
+	defer watchdog.Stop()
+
+	deregister := watchdog.Register("test-op", op)
+	defer deregister()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pings >= 3
+	}, time.Second, time.Millisecond)
+
+	close(op.unblockCh)
+}
+
+func TestWatchdog_StopsPingingAfterDeregister(t *testing.T) {
+	op := &blockingOp{startTime: time.Now(), unblockCh: make(chan struct{})}
+
+	var mu sync.Mutex
+	pings := 0
+	watchdog := NewWatchdog(time.Millisecond, func(name string, inFlight time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		pings++
+	})
+	defer watchdog.Stop()
+
+	deregister := watchdog.Register("test-op", op)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return pings >= 1
+	}, time.Second, time.Millisecond)
+	deregister()
+
+	mu.Lock()
+	pingsAtDeregister := pings
+	mu.Unlock()
+
+	time.Sleep(20 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, pingsAtDeregister, pings)
+}
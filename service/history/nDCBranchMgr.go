@@ -0,0 +1,584 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	ctx "context"
+	"errors"
+	"fmt"
+	goruntime "runtime"
+	"sync"
+	"time"
+
+	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/cache"
+	"github.com/uber/cadence/common/cluster"
+	"github.com/uber/cadence/common/deadlock"
+	"github.com/uber/cadence/common/log"
+	"github.com/uber/cadence/common/log/tag"
+	"github.com/uber/cadence/common/metrics"
+	"github.com/uber/cadence/common/persistence"
+)
+
+var (
+	// ErrDomainNotActiveLocally is returned when a branch fork is requested for a domain
+	// that is not registered on the current cluster. Forking in this case would create a
+	// phantom branch that nothing will ever replicate into, so the caller should skip the
+	// event batch instead.
+	ErrDomainNotActiveLocally = errors.New("domain is not active on the local cluster")
+
+	// ErrSkipCountExceeded is returned when prepareVersionHistory has bailed out without
+	// producing a usable branch index more times than the configured skip budget allows.
+	// The caller should stop retrying and persist the event batch to the DLQ instead.
+	ErrSkipCountExceeded = errors.New("exceeded the allowed number of skipped branch preparations")
+
+	// ErrCorruptedVersionHistories is returned when the mutable state's VersionHistories
+	// fail validateVersionHistories' invariant checks. Before this is returned, the offending
+	// VersionHistories are written to the replication_dlq_corrupt_histories table on a
+	// best-effort basis (a failed write is only logged), so an operator can inspect and
+	// repair the mutable state out of band.
+	ErrCorruptedVersionHistories = errors.New("version histories failed validation and were recorded to the corrupt history DLQ")
+)
+
+type (
+	nDCBranchMgr interface {
+		prepareVersionHistory(
+			ctx ctx.Context,
+			incomingVersionHistory *persistence.VersionHistory,
+		) (int, error)
+		createNewBranch(
+			ctx ctx.Context,
+			baseBranchToken []byte,
+			baseBranchLastEventID int64,
+			newVersionHistory *persistence.VersionHistory,
+		) (int, error)
+	}
+
+	nDCBranchMgrImpl struct {
+		shard            ShardContext
+		context          workflowExecutionContext
+		mutableState     mutableState
+		domainCache      cache.DomainCache
+		clusterMetadata  cluster.Metadata
+		historyV2Mgr     persistence.HistoryV2Manager
+		executionManager persistence.ExecutionManager
+		metricsClient    metrics.Client
+		logger           log.Logger
+	}
+
+	// nDCBranchMgrOperation implements deadlock.Pingable for a single in-flight
+	// branch-manager operation.
+	nDCBranchMgrOperation struct {
+		startTime time.Time
+	}
+)
+
+var _ nDCBranchMgr = (*nDCBranchMgrImpl)(nil)
+var _ deadlock.Pingable = (*nDCBranchMgrOperation)(nil)
+
+var (
+	// ndcBranchMgrWatchdogs holds one watchdog per shard, shared by every nDCBranchMgrImpl
+	// created for that shard. Branch managers are constructed per call and would otherwise
+	// leak a ticker goroutine apiece; caching by shard bounds the goroutine count to the
+	// number of shards this host currently owns instead of growing with replication traffic.
+	ndcBranchMgrWatchdogsMu sync.Mutex
+	ndcBranchMgrWatchdogs   = make(map[ShardContext]*deadlock.Watchdog)
+
+	// ndcBranchMgrHangAlertsMu guards ndcBranchMgrHangAlerts, which throttles the
+	// stack-dump log and metric for a still-hanging operation to once per
+	// ndcBranchMgrHangAlertCooldown instead of on every watchdog tick. It is keyed by
+	// shard and then by registered operation name, so that a shard's entries can be
+	// dropped together once the shard closes.
+	ndcBranchMgrHangAlertsMu sync.Mutex
+	ndcBranchMgrHangAlerts   = make(map[ShardContext]map[string]time.Time)
+
+	// ndcBranchMgrSkipCountsMu guards ndcBranchMgrSkipCounts, the per-workflow skip budget.
+	// It is tracked per shard rather than on nDCBranchMgrImpl itself, since a branch manager
+	// is constructed fresh for every replication attempt (see newNDCBranchMgr) and would
+	// otherwise never see more than a single skip no matter how many times the replication
+	// feed retries the same workflow.
+	ndcBranchMgrSkipCountsMu sync.Mutex
+	ndcBranchMgrSkipCounts   = make(map[ShardContext]map[ndcBranchMgrSkipKey]int)
+)
+
+const ndcBranchMgrHangAlertCooldown = time.Minute
+
+// ndcBranchMgrSkipKey identifies the workflow a skip budget is tracked against.
+type ndcBranchMgrSkipKey struct {
+	domainID   string
+	workflowID string
+	runID      string
+}
+
+func ndcBranchMgrSkipKeyFor(executionInfo *persistence.WorkflowExecutionInfo) ndcBranchMgrSkipKey {
+	return ndcBranchMgrSkipKey{
+		domainID:   executionInfo.DomainID,
+		workflowID: executionInfo.WorkflowID,
+		runID:      executionInfo.RunID,
+	}
+}
+
+func newNDCBranchMgr(
+	shard ShardContext,
+	context workflowExecutionContext,
+	mutableState mutableState,
+	logger log.Logger,
+) *nDCBranchMgrImpl {
+
+	return &nDCBranchMgrImpl{
+		shard:            shard,
+		context:          context,
+		mutableState:     mutableState,
+		domainCache:      shard.GetDomainCache(),
+		clusterMetadata:  shard.GetService().GetClusterMetadata(),
+		historyV2Mgr:     shard.GetHistoryManager(),
+		executionManager: shard.GetExecutionManager(),
+		metricsClient:    shard.GetMetricsClient(),
+		logger:           logger,
+	}
+}
+
+// Ping reports how long this operation has been in flight.
+func (o *nDCBranchMgrOperation) Ping() time.Duration {
+	return time.Since(o.startTime)
+}
+
+// watchdogForShard returns the watchdog shared by every branch manager operating on
+// shard, creating it on first use. A goroutine is started alongside a freshly created
+// watchdog to release it, and every other piece of shard-keyed state this file keeps,
+// once the shard closes - otherwise every shard handoff would leak one ticker goroutine
+// and map entry for the life of the process.
+func watchdogForShard(shard ShardContext) *deadlock.Watchdog {
+	ndcBranchMgrWatchdogsMu.Lock()
+	defer ndcBranchMgrWatchdogsMu.Unlock()
+
+	if w, ok := ndcBranchMgrWatchdogs[shard]; ok {
+		return w
+	}
+	w := deadlock.NewWatchdog(shard.GetConfig().NDCBranchMgrWatchdogPingInterval(), func(name string, inFlight time.Duration) {
+		onNDCBranchMgrOperationHang(shard, name, inFlight)
+	})
+	ndcBranchMgrWatchdogs[shard] = w
+	go deregisterNDCBranchMgrOnShardClose(shard, w)
+	return w
+}
+
+// deregisterNDCBranchMgrOnShardClose blocks until shard closes, then stops w and drops
+// every map entry this file keeps for shard, so a future shard with the same identity
+// (or, far more commonly, a different shard taking its place after a host restart) starts
+// from a clean slate instead of accumulating state for every shard this host has ever
+// owned. Only a *shardContextImpl has a close channel to wait on; for any other
+// ShardContext the function does not block, and w is stopped and its state dropped at once.
+func deregisterNDCBranchMgrOnShardClose(shard ShardContext, w *deadlock.Watchdog) {
+	if shardContext, ok := shard.(*shardContextImpl); ok {
+		<-shardContext.closeCh
+	}
+
+	w.Stop()
+
+	ndcBranchMgrWatchdogsMu.Lock()
+	delete(ndcBranchMgrWatchdogs, shard)
+	ndcBranchMgrWatchdogsMu.Unlock()
+
+	ndcBranchMgrHangAlertsMu.Lock()
+	delete(ndcBranchMgrHangAlerts, shard)
+	ndcBranchMgrHangAlertsMu.Unlock()
+
+	ndcBranchMgrSkipCountsMu.Lock()
+	delete(ndcBranchMgrSkipCounts, shard)
+	ndcBranchMgrSkipCountsMu.Unlock()
+}
+
+// registerWatchdogOp registers opName with the shard's watchdog before a long-running
+// createNewBranch/prepareVersionHistory call enters persistence, and returns a function
+// that deregisters it. Callers should defer the returned function so the operation is
+// always deregistered, whether it returns successfully or bails out early.
+func (r *nDCBranchMgrImpl) registerWatchdogOp(opName string) (deregister func()) {
+	op := &nDCBranchMgrOperation{startTime: time.Now()}
+	// the op's address keeps the name unique when several operations of the same kind run
+	// on one shard at once, so deregistering one never removes another's entry
+	name := fmt.Sprintf("shard-%d:%s:%p", r.shard.GetShardID(), opName, op)
+	return watchdogForShard(r.shard).Register(name, op)
+}
+
+// onNDCBranchMgrOperationHang is invoked by a shard's watchdog for every in-flight
+// operation on every tick. Operations below the hang threshold are ignored; operations
+// past it are logged and metered (at most once per ndcBranchMgrHangAlertCooldown, so a
+// persistent hang doesn't re-dump every goroutine's stack on every tick), and operations
+// past the (longer) abort threshold cause the shard to be closed so a new owner can take
+// over.
+func onNDCBranchMgrOperationHang(shard ShardContext, name string, inFlight time.Duration) {
+	hangThreshold := shard.GetConfig().NDCBranchMgrHangThreshold()
+	if inFlight < hangThreshold {
+		return
+	}
+
+	// The abort decision below must run on every tick regardless of alert throttling;
+	// only the noisy stack dump and metric are rate-limited.
+	if ndcBranchMgrShouldAlert(shard, name) {
+		shard.GetMetricsClient().IncCounter(metrics.ReplicateHistoryEventsScope, metrics.NDCBranchMgrHangCounter)
+
+		buf := make([]byte, 1<<16)
+		n := goruntime.Stack(buf, true)
+		shard.GetLogger().Error("NDC branch manager operation has been in flight too long",
+			tag.Value(name),
+			tag.Value(inFlight.String()),
+			tag.Value(string(buf[:n])),
+		)
+	}
+
+	abortThreshold := shard.GetConfig().NDCBranchMgrAbortThreshold()
+	if inFlight < abortThreshold {
+		return
+	}
+
+	if shardContext, ok := shard.(*shardContextImpl); ok {
+		select {
+		case shardContext.closeCh <- 0:
+		default:
+		}
+	}
+}
+
+// ndcBranchMgrShouldAlert reports whether shard's hung operation name has not already
+// been alerted on within the last ndcBranchMgrHangAlertCooldown, recording the alert if
+// so.
+func ndcBranchMgrShouldAlert(shard ShardContext, name string) bool {
+	ndcBranchMgrHangAlertsMu.Lock()
+	defer ndcBranchMgrHangAlertsMu.Unlock()
+
+	alerts, ok := ndcBranchMgrHangAlerts[shard]
+	if !ok {
+		alerts = make(map[string]time.Time)
+		ndcBranchMgrHangAlerts[shard] = alerts
+	}
+	if last, ok := alerts[name]; ok && time.Since(last) < ndcBranchMgrHangAlertCooldown {
+		return false
+	}
+	alerts[name] = time.Now()
+	return true
+}
+
+// prepareVersionHistory finds out the best incoming version history to be considered as
+// current version history. It is also responsible for forking a new branch when the
+// incoming version history does not append to the current one.
+func (r *nDCBranchMgrImpl) prepareVersionHistory(
+	ctx ctx.Context,
+	incomingVersionHistory *persistence.VersionHistory,
+) (int, error) {
+
+	deregister := r.registerWatchdogOp("prepareVersionHistory")
+	defer deregister()
+
+	versionHistories := r.mutableState.GetVersionHistories()
+	if err := r.validateVersionHistories(ctx, versionHistories, incomingVersionHistory); err != nil {
+		return 0, err
+	}
+
+	executionInfo := r.mutableState.GetExecutionInfo()
+	domainName, err := r.skipIfDomainNotActiveLocally(executionInfo)
+	if err != nil {
+		return 0, r.recordSkip(executionInfo, domainName, err)
+	}
+
+	currentVersionHistoryIndex := versionHistories.GetCurrentVersionHistoryIndex()
+
+	currentVersionHistory, err := versionHistories.GetVersionHistory(currentVersionHistoryIndex)
+	if err != nil {
+		return 0, r.recordSkip(executionInfo, domainName, err)
+	}
+	lcaItem, err := currentVersionHistory.FindLCAItem(incomingVersionHistory)
+	if err != nil {
+		return 0, r.recordSkip(executionInfo, domainName, err)
+	}
+
+	// if can directly append to the current branch
+	if currentVersionHistory.IsLCAAppendable(lcaItem) {
+		r.resetSkipCount(executionInfo)
+		return currentVersionHistoryIndex, nil
+	}
+
+	// the incoming version history branches off the current one at the LCA item,
+	// so a new branch needs to be forked from that point
+	newVersionHistory, err := incomingVersionHistory.DuplicateUntilLCAItem(lcaItem)
+	if err != nil {
+		return 0, r.recordSkip(executionInfo, domainName, err)
+	}
+
+	newVersionHistoryIndex, err := r.createNewBranch(
+		ctx,
+		currentVersionHistory.GetBranchToken(),
+		lcaItem.GetEventID(),
+		newVersionHistory,
+	)
+	if err != nil {
+		return 0, r.recordSkip(executionInfo, domainName, err)
+	}
+
+	r.resetSkipCount(executionInfo)
+	return newVersionHistoryIndex, nil
+}
+
+// createNewBranch forks a new history branch at baseBranchLastEventID and records the
+// resulting branch token as a new entry in the workflow's version histories.
+func (r *nDCBranchMgrImpl) createNewBranch(
+	ctx ctx.Context,
+	baseBranchToken []byte,
+	baseBranchLastEventID int64,
+	newVersionHistory *persistence.VersionHistory,
+) (int, error) {
+
+	deregister := r.registerWatchdogOp("createNewBranch")
+	defer deregister()
+
+	shardID := r.shard.GetShardID()
+	executionInfo := r.mutableState.GetExecutionInfo()
+
+	resp, err := r.historyV2Mgr.ForkHistoryBranch(&persistence.ForkHistoryBranchRequest{
+		ForkBranchToken: baseBranchToken,
+		ForkNodeID:      baseBranchLastEventID + 1,
+		Info: persistence.BuildHistoryGarbageCleanupInfo(
+			executionInfo.DomainID,
+			executionInfo.WorkflowID,
+			executionInfo.RunID,
+		),
+		ShardID: common.IntPtr(shardID),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := newVersionHistory.SetBranchToken(resp.NewBranchToken); err != nil {
+		return 0, err
+	}
+
+	versionHistories := r.mutableState.GetVersionHistories()
+	currentVersionHistory, err := versionHistories.GetVersionHistory(versionHistories.GetCurrentVersionHistoryIndex())
+	if err != nil {
+		return 0, err
+	}
+	lastItem, err := currentVersionHistory.GetLastItem()
+	if err != nil {
+		return 0, err
+	}
+
+	// if the branch being forked from is currently active in a remote cluster, this
+	// cluster is only replicating history, so the workflow should be marked passive
+	sourceCluster := r.clusterMetadata.ClusterNameForFailoverVersion(lastItem.GetVersion())
+	if sourceCluster != r.clusterMetadata.GetCurrentClusterName() {
+		if err := r.context.updateWorkflowExecutionAsPassive(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	newVersionHistoryIndex, err := versionHistories.AddVersionHistory(newVersionHistory)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := r.historyV2Mgr.CompleteForkBranch(&persistence.CompleteForkBranchRequest{
+		BranchToken: resp.NewBranchToken,
+		Success:     true,
+		ShardID:     common.IntPtr(shardID),
+	}); err != nil {
+		return 0, err
+	}
+
+	return newVersionHistoryIndex, nil
+}
+
+// validateVersionHistories walks the mutable state's VersionHistories and asserts the
+// invariants a healthy nDC workflow must satisfy before a fork is attempted: event IDs and
+// versions are monotonic within each branch, no two branches share a branch token, and the
+// current branch's last item is not behind the persisted NextEventID. Any violation is
+// recorded to the corrupt-history DLQ via recordCorruptVersionHistories.
+func (r *nDCBranchMgrImpl) validateVersionHistories(
+	ctx ctx.Context,
+	versionHistories *persistence.VersionHistories,
+	incomingVersionHistory *persistence.VersionHistory,
+) error {
+
+	branchTokens := make(map[string]struct{})
+	for i := 0; ; i++ {
+		versionHistory, err := versionHistories.GetVersionHistory(i)
+		if err != nil {
+			break
+		}
+
+		branchToken := string(versionHistory.GetBranchToken())
+		if _, exists := branchTokens[branchToken]; exists {
+			return r.recordCorruptVersionHistories(ctx, incomingVersionHistory, versionHistories,
+				fmt.Sprintf("branch %d shares its branch token with an earlier branch", i))
+		}
+		branchTokens[branchToken] = struct{}{}
+
+		items := versionHistory.GetItems()
+		for j := 1; j < len(items); j++ {
+			if items[j].GetEventID() <= items[j-1].GetEventID() {
+				return r.recordCorruptVersionHistories(ctx, incomingVersionHistory, versionHistories,
+					fmt.Sprintf("branch %d has non-monotonic event IDs", i))
+			}
+			if items[j].GetVersion() < items[j-1].GetVersion() {
+				return r.recordCorruptVersionHistories(ctx, incomingVersionHistory, versionHistories,
+					fmt.Sprintf("branch %d has non-monotonic versions", i))
+			}
+		}
+	}
+
+	currentVersionHistory, err := versionHistories.GetVersionHistory(versionHistories.GetCurrentVersionHistoryIndex())
+	if err != nil {
+		return r.recordCorruptVersionHistories(ctx, incomingVersionHistory, versionHistories,
+			"current version history index does not point at an existing branch")
+	}
+	lastItem, err := currentVersionHistory.GetLastItem()
+	if err != nil {
+		return r.recordCorruptVersionHistories(ctx, incomingVersionHistory, versionHistories,
+			"current branch has no items")
+	}
+
+	executionInfo := r.mutableState.GetExecutionInfo()
+	if lastItem.GetEventID() < executionInfo.NextEventID-1 {
+		return r.recordCorruptVersionHistories(ctx, incomingVersionHistory, versionHistories,
+			"current branch's last event ID trails the persisted NextEventID")
+	}
+
+	return nil
+}
+
+// recordCorruptVersionHistories emits a metric and an error log, then persists
+// corruptVersionHistories and the incoming version history that exposed the corruption to
+// the replication_dlq_corrupt_histories table so an operator can repair the mutable state
+// out of band, and returns ErrCorruptedVersionHistories. The DLQ write is best-effort: a failure is logged but does
+// not change the returned error, since the corruption itself must still halt replication.
+func (r *nDCBranchMgrImpl) recordCorruptVersionHistories(
+	ctx ctx.Context,
+	incomingVersionHistory *persistence.VersionHistory,
+	corruptVersionHistories *persistence.VersionHistories,
+	reason string,
+) error {
+	executionInfo := r.mutableState.GetExecutionInfo()
+
+	r.metricsClient.IncCounter(metrics.ReplicateHistoryEventsScope, metrics.NDCCorruptVersionHistoryCounter)
+	r.logger.Error("NDC branch manager detected corrupted version histories",
+		tag.WorkflowDomainID(executionInfo.DomainID),
+		tag.WorkflowID(executionInfo.WorkflowID),
+		tag.WorkflowRunID(executionInfo.RunID),
+		tag.Value(reason),
+	)
+
+	if err := r.executionManager.PutReplicationDLQCorruptVersionHistories(ctx, &persistence.PutReplicationDLQCorruptVersionHistoriesRequest{
+		DomainID:                executionInfo.DomainID,
+		WorkflowID:              executionInfo.WorkflowID,
+		RunID:                   executionInfo.RunID,
+		Reason:                  reason,
+		CorruptVersionHistories: corruptVersionHistories,
+		IncomingVersionHistory:  incomingVersionHistory,
+	}); err != nil {
+		r.logger.Error("failed to persist corrupted version histories to the DLQ",
+			tag.WorkflowDomainID(executionInfo.DomainID),
+			tag.WorkflowID(executionInfo.WorkflowID),
+			tag.WorkflowRunID(executionInfo.RunID),
+			tag.Error(err),
+		)
+	}
+
+	return ErrCorruptedVersionHistories
+}
+
+// skipIfDomainNotActiveLocally guards against forking a new branch for a domain that is
+// not registered on this cluster. Replicating history for a domain that has since been
+// unregistered locally would otherwise leave behind phantom branches no one will ever
+// clean up. The domain name is returned whenever the domain lookup succeeds, whether or
+// not the domain is on this cluster, so the caller can use it to track the per-domain skip
+// budget; if the lookup fails, the name is empty.
+func (r *nDCBranchMgrImpl) skipIfDomainNotActiveLocally(executionInfo *persistence.WorkflowExecutionInfo) (string, error) {
+	domainEntry, err := r.domainCache.GetDomainByID(executionInfo.DomainID)
+	if err != nil {
+		return "", err
+	}
+	domainName := domainEntry.GetInfo().Name
+
+	currentClusterName := r.clusterMetadata.GetCurrentClusterName()
+	if domainEntry.IsOnCluster(currentClusterName) {
+		return domainName, nil
+	}
+
+	r.metricsClient.IncCounter(metrics.ReplicateHistoryEventsScope, metrics.NDCBranchMgrDomainNotActiveCounter)
+	r.logger.Info("skipping branch fork for domain not active on local cluster",
+		tag.WorkflowDomainID(executionInfo.DomainID),
+		tag.WorkflowID(executionInfo.WorkflowID),
+		tag.WorkflowRunID(executionInfo.RunID),
+		tag.ClusterName(currentClusterName),
+	)
+	return domainName, ErrDomainNotActiveLocally
+}
+
+// recordSkip increments the per-workflow skip budget every time prepareVersionHistory bails
+// out without producing a usable branch index after its version histories have passed
+// validateVersionHistories; ErrCorruptedVersionHistories is returned directly and does not
+// count against the budget. Once the configured budget is exceeded it
+// returns ErrSkipCountExceeded so the caller can stop retrying and persist to the DLQ
+// instead of looping forever against a version history that will never resolve. The budget
+// is tracked per shard rather than on this nDCBranchMgrImpl, since a fresh manager is
+// constructed for every replication attempt (see newNDCBranchMgr).
+func (r *nDCBranchMgrImpl) recordSkip(executionInfo *persistence.WorkflowExecutionInfo, domainName string, cause error) error {
+	skipCount := r.incrementSkipCount(executionInfo)
+	scope := r.metricsClient.Scope(metrics.ReplicateHistoryEventsScope, metrics.DomainTag(domainName))
+
+	maxSkipCount := r.shard.GetConfig().NDCBranchMgrMaxSkipCount(domainName)
+	if skipCount > maxSkipCount {
+		scope.IncCounter(metrics.NDCBranchMgrSkipBudgetExhaustedCounter)
+		r.logger.Error("NDC branch manager skip budget exhausted",
+			tag.Value(skipCount),
+			tag.Error(cause),
+		)
+		return ErrSkipCountExceeded
+	}
+
+	scope.IncCounter(metrics.NDCBranchMgrSkipCountCounter)
+	return cause
+}
+
+// resetSkipCount clears the skip budget after a successful prepare.
+func (r *nDCBranchMgrImpl) resetSkipCount(executionInfo *persistence.WorkflowExecutionInfo) {
+	ndcBranchMgrSkipCountsMu.Lock()
+	defer ndcBranchMgrSkipCountsMu.Unlock()
+
+	if counts, ok := ndcBranchMgrSkipCounts[r.shard]; ok {
+		delete(counts, ndcBranchMgrSkipKeyFor(executionInfo))
+	}
+}
+
+// incrementSkipCount bumps and returns the skip count tracked for this workflow on this
+// shard, creating the shard's entry on first use.
+func (r *nDCBranchMgrImpl) incrementSkipCount(executionInfo *persistence.WorkflowExecutionInfo) int {
+	ndcBranchMgrSkipCountsMu.Lock()
+	defer ndcBranchMgrSkipCountsMu.Unlock()
+
+	counts, ok := ndcBranchMgrSkipCounts[r.shard]
+	if !ok {
+		counts = make(map[ndcBranchMgrSkipKey]int)
+		ndcBranchMgrSkipCounts[r.shard] = counts
+	}
+	key := ndcBranchMgrSkipKeyFor(executionInfo)
+	counts[key]++
+	return counts[key]
+}
@@ -23,13 +23,16 @@ package history
 import (
 	ctx "context"
 	"testing"
+	"time"
 
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	"github.com/uber-go/tally"
 
 	"github.com/uber/cadence/common"
+	"github.com/uber/cadence/common/cache"
 	"github.com/uber/cadence/common/clock"
 	"github.com/uber/cadence/common/cluster"
 	"github.com/uber/cadence/common/log"
@@ -38,6 +41,7 @@ import (
 	"github.com/uber/cadence/common/mocks"
 	"github.com/uber/cadence/common/persistence"
 	"github.com/uber/cadence/common/service"
+	"github.com/uber/cadence/common/service/dynamicconfig"
 )
 
 type (
@@ -48,6 +52,8 @@ type (
 		mockShard           *shardContextImpl
 		mockHistoryV2Mgr    *mocks.HistoryV2Manager
 		mockClusterMetadata *mocks.ClusterMetadata
+		mockDomainCache     *mocks.DomainCache
+		mockExecutionMgr    *mocks.ExecutionManager
 		mockContext         *mockWorkflowExecutionContext
 		mockMutableState    *mockMutableState
 		logger              log.Logger
@@ -70,6 +76,8 @@ func (s *nDCBranchMgrSuite) SetupTest() {
 	s.logger = loggerimpl.NewDevelopmentForTest(s.Suite)
 	s.mockHistoryV2Mgr = &mocks.HistoryV2Manager{}
 	s.mockClusterMetadata = &mocks.ClusterMetadata{}
+	s.mockDomainCache = &mocks.DomainCache{}
+	s.mockExecutionMgr = &mocks.ExecutionManager{}
 	metricsClient := metrics.NewClient(tally.NoopScope, metrics.History)
 	s.mockService = service.NewTestService(s.mockClusterMetadata, nil, metricsClient, nil, nil, nil)
 
@@ -78,6 +86,8 @@ func (s *nDCBranchMgrSuite) SetupTest() {
 		shardInfo:                 &persistence.ShardInfo{ShardID: 10, RangeID: 1, TransferAckLevel: 0},
 		transferSequenceNumber:    1,
 		historyV2Mgr:              s.mockHistoryV2Mgr,
+		domainCache:               s.mockDomainCache,
+		executionManager:          s.mockExecutionMgr,
 		maxTransferSequenceNumber: 100000,
 		closeCh:                   make(chan int, 100),
 		config:                    NewDynamicConfigForTest(),
@@ -98,10 +108,56 @@ func (s *nDCBranchMgrSuite) SetupTest() {
 	)
 }
 
+// domainEntryOnCluster returns a domain cache entry whose replication config includes the
+// given cluster name, mirroring how a domain registered on the local cluster would look.
+func (s *nDCBranchMgrSuite) domainEntryOnCluster(clusterName string) *cache.DomainCacheEntry {
+	return cache.NewGlobalDomainCacheEntryForTest(
+		&persistence.DomainInfo{ID: s.domainID, Name: "some random domain name"},
+		&persistence.DomainConfig{Retention: 1},
+		&persistence.DomainReplicationConfig{
+			Clusters: []*persistence.ClusterReplicationConfig{
+				{ClusterName: clusterName},
+			},
+		},
+		int64(0),
+	)
+}
+
+// skipCountFor and setSkipCountFor read and seed the package-level, shard-scoped skip
+// budget that backs recordSkip/resetSkipCount, since the suite's workflow identity is
+// fixed across a test.
+func (s *nDCBranchMgrSuite) skipCountFor(shard ShardContext) int {
+	ndcBranchMgrSkipCountsMu.Lock()
+	defer ndcBranchMgrSkipCountsMu.Unlock()
+
+	return ndcBranchMgrSkipCounts[shard][ndcBranchMgrSkipKey{
+		domainID:   s.domainID,
+		workflowID: s.workflowID,
+		runID:      s.runID,
+	}]
+}
+
+func (s *nDCBranchMgrSuite) setSkipCountFor(shard ShardContext, count int) {
+	ndcBranchMgrSkipCountsMu.Lock()
+	defer ndcBranchMgrSkipCountsMu.Unlock()
+
+	counts, ok := ndcBranchMgrSkipCounts[shard]
+	if !ok {
+		counts = make(map[ndcBranchMgrSkipKey]int)
+		ndcBranchMgrSkipCounts[shard] = counts
+	}
+	counts[ndcBranchMgrSkipKey{
+		domainID:   s.domainID,
+		workflowID: s.workflowID,
+		runID:      s.runID,
+	}] = count
+}
+
 func (s *nDCBranchMgrSuite) TearDownTest() {
 	s.mockHistoryV2Mgr.AssertExpectations(s.T())
 	s.mockContext.AssertExpectations(s.T())
 	s.mockMutableState.AssertExpectations(s.T())
+	s.mockExecutionMgr.AssertExpectations(s.T())
 }
 
 func (s *nDCBranchMgrSuite) TestCreateNewBranch() {
@@ -183,6 +239,14 @@ func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_Appendable() {
 	s.NoError(err)
 
 	s.mockMutableState.On("GetVersionHistories").Return(versionHistories).Once()
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Twice()
+	s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+		s.domainEntryOnCluster(cluster.TestCurrentClusterName), nil,
+	).Once()
 
 	index, err := s.nDCBranchMgr.prepareVersionHistory(ctx.Background(), incomingVersionHistory)
 	s.NoError(err)
@@ -218,7 +282,10 @@ func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_NotAppendable() {
 		DomainID:   s.domainID,
 		WorkflowID: s.workflowID,
 		RunID:      s.runID,
-	}).Once()
+	}).Times(3)
+	s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+		s.domainEntryOnCluster(cluster.TestCurrentClusterName), nil,
+	).Once()
 
 	s.mockClusterMetadata.On("ClusterNameForFailoverVersion", baseBranchLastEventVersion).Return(cluster.TestAlternativeClusterName)
 	s.mockContext.On("updateWorkflowExecutionAsPassive", mock.Anything).Return(nil)
@@ -245,3 +312,362 @@ func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_NotAppendable() {
 	s.NoError(err)
 	s.Equal(1, index)
 }
+
+func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_DomainActiveOnCluster() {
+	versionHistory := persistence.NewVersionHistory([]byte("some random base branch token"), []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+		persistence.NewVersionHistoryItem(50, 100),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+
+	incomingVersionHistory := versionHistory.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Twice()
+	s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+		s.domainEntryOnCluster(cluster.TestCurrentClusterName), nil,
+	).Once()
+	s.mockMutableState.On("GetVersionHistories").Return(versionHistories).Once()
+
+	index, err := s.nDCBranchMgr.prepareVersionHistory(ctx.Background(), incomingVersionHistory)
+	s.NoError(err)
+	s.Equal(0, index)
+}
+
+func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_DomainNotActiveLocally() {
+	versionHistory := persistence.NewVersionHistory([]byte("some random base branch token"), []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+		persistence.NewVersionHistoryItem(50, 100),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+
+	incomingVersionHistory := versionHistory.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Twice()
+	s.mockMutableState.On("GetVersionHistories").Return(versionHistories).Once()
+	s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+		s.domainEntryOnCluster(cluster.TestAlternativeClusterName), nil,
+	).Once()
+
+	index, err := s.nDCBranchMgr.prepareVersionHistory(ctx.Background(), incomingVersionHistory)
+	s.Equal(ErrDomainNotActiveLocally, err)
+	s.Equal(0, index)
+}
+
+func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_SkipBudget_Accumulates() {
+	s.mockShard.config.NDCBranchMgrMaxSkipCount = dynamicconfig.GetIntPropertyFilteredByDomain(5)
+
+	incomingVersionHistory := persistence.NewVersionHistory(nil, []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+	})
+	versionHistories := persistence.NewVersionHistories(persistence.NewVersionHistory(
+		[]byte("some random base branch token"),
+		[]*persistence.VersionHistoryItem{
+			persistence.NewVersionHistoryItem(10, 0),
+		},
+	))
+
+	for i := 1; i <= 3; i++ {
+		s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+			DomainID:   s.domainID,
+			WorkflowID: s.workflowID,
+			RunID:      s.runID,
+		}).Twice()
+		s.mockMutableState.On("GetVersionHistories").Return(versionHistories).Once()
+		s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+			s.domainEntryOnCluster(cluster.TestAlternativeClusterName), nil,
+		).Once()
+
+		_, err := s.nDCBranchMgr.prepareVersionHistory(ctx.Background(), incomingVersionHistory)
+		s.Equal(ErrDomainNotActiveLocally, err)
+		s.Equal(i, s.skipCountFor(s.mockShard))
+	}
+}
+
+func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_SkipBudget_Exhausted() {
+	s.mockShard.config.NDCBranchMgrMaxSkipCount = dynamicconfig.GetIntPropertyFilteredByDomain(2)
+
+	incomingVersionHistory := persistence.NewVersionHistory(nil, []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+	})
+	versionHistories := persistence.NewVersionHistories(persistence.NewVersionHistory(
+		[]byte("some random base branch token"),
+		[]*persistence.VersionHistoryItem{
+			persistence.NewVersionHistoryItem(10, 0),
+		},
+	))
+
+	for i := 0; i < 2; i++ {
+		s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+			DomainID:   s.domainID,
+			WorkflowID: s.workflowID,
+			RunID:      s.runID,
+		}).Twice()
+		s.mockMutableState.On("GetVersionHistories").Return(versionHistories).Once()
+		s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+			s.domainEntryOnCluster(cluster.TestAlternativeClusterName), nil,
+		).Once()
+
+		_, err := s.nDCBranchMgr.prepareVersionHistory(ctx.Background(), incomingVersionHistory)
+		s.Equal(ErrDomainNotActiveLocally, err)
+	}
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Twice()
+	s.mockMutableState.On("GetVersionHistories").Return(versionHistories).Once()
+	s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+		s.domainEntryOnCluster(cluster.TestAlternativeClusterName), nil,
+	).Once()
+
+	_, err := s.nDCBranchMgr.prepareVersionHistory(ctx.Background(), incomingVersionHistory)
+	s.Equal(ErrSkipCountExceeded, err)
+}
+
+func (s *nDCBranchMgrSuite) TestPrepareVersionHistory_SkipBudget_ResetOnSuccess() {
+	s.mockShard.config.NDCBranchMgrMaxSkipCount = dynamicconfig.GetIntPropertyFilteredByDomain(5)
+	s.setSkipCountFor(s.mockShard, 3)
+
+	versionHistory := persistence.NewVersionHistory([]byte("some random base branch token"), []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+		persistence.NewVersionHistoryItem(50, 100),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+	incomingVersionHistory := versionHistory.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Twice()
+	s.mockDomainCache.On("GetDomainByID", s.domainID).Return(
+		s.domainEntryOnCluster(cluster.TestCurrentClusterName), nil,
+	).Once()
+	s.mockMutableState.On("GetVersionHistories").Return(versionHistories).Once()
+
+	index, err := s.nDCBranchMgr.prepareVersionHistory(ctx.Background(), incomingVersionHistory)
+	s.NoError(err)
+	s.Equal(0, index)
+	s.Equal(0, s.skipCountFor(s.mockShard))
+}
+
+func (s *nDCBranchMgrSuite) TestCreateNewBranch_WatchdogFiresOnHang() {
+	s.mockShard.config.NDCBranchMgrWatchdogPingInterval = dynamicconfig.GetDurationPropertyFn(time.Millisecond)
+	s.mockShard.config.NDCBranchMgrHangThreshold = dynamicconfig.GetDurationPropertyFn(time.Millisecond)
+	s.mockShard.config.NDCBranchMgrAbortThreshold = dynamicconfig.GetDurationPropertyFn(time.Hour)
+
+	testScope := tally.NewTestScope("", nil)
+	s.mockShard.metricsClient = metrics.NewClient(testScope, metrics.History)
+
+	baseBranchToken := []byte("some random base branch token")
+	baseBranchLCAEventID := int64(1394)
+	newVersionHistory := persistence.NewVersionHistory(nil, []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+	})
+	versionHistory := persistence.NewVersionHistory(baseBranchToken, []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(baseBranchLCAEventID, 200),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+
+	unblockCh := make(chan struct{})
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	})
+	s.mockMutableState.On("GetVersionHistories").Return(versionHistories)
+	s.mockClusterMetadata.On("ClusterNameForFailoverVersion", int64(200)).Return(cluster.TestCurrentClusterName)
+	s.mockHistoryV2Mgr.On("ForkHistoryBranch", mock.Anything).Run(func(mock.Arguments) {
+		<-unblockCh
+	}).Return(&persistence.ForkHistoryBranchResponse{
+		NewBranchToken: []byte("some random new branch token"),
+	}, nil).Once()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.nDCBranchMgr.createNewBranch(ctx.Background(), baseBranchToken, baseBranchLCAEventID, newVersionHistory)
+		done <- err
+	}()
+
+	require.Eventually(s.T(), func() bool {
+		for _, counter := range testScope.Snapshot().Counters() {
+			if counter.Value() > 0 {
+				return true
+			}
+		}
+		return false
+	}, time.Second, time.Millisecond, "watchdog should have reported the hung createNewBranch call")
+
+	s.mockHistoryV2Mgr.On("CompleteForkBranch", mock.Anything).Return(nil).Once()
+	close(unblockCh)
+
+	select {
+	case err := <-done:
+		s.NoError(err)
+	case <-time.After(time.Second):
+		s.Fail("createNewBranch did not return after being unblocked")
+	}
+}
+
+func (s *nDCBranchMgrSuite) TestCreateNewBranch_WatchdogAbortsShardOnPersistentHang() {
+	s.mockShard.config.NDCBranchMgrWatchdogPingInterval = dynamicconfig.GetDurationPropertyFn(time.Millisecond)
+	s.mockShard.config.NDCBranchMgrHangThreshold = dynamicconfig.GetDurationPropertyFn(time.Millisecond)
+	s.mockShard.config.NDCBranchMgrAbortThreshold = dynamicconfig.GetDurationPropertyFn(2 * time.Millisecond)
+
+	// ForkHistoryBranch never returns; the operation stays registered with the watchdog
+	// for the lifetime of this test so the abort threshold is guaranteed to be crossed.
+	unblockCh := make(chan struct{})
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	})
+	s.mockHistoryV2Mgr.On("ForkHistoryBranch", mock.Anything).Run(func(mock.Arguments) {
+		<-unblockCh
+	}).Return(&persistence.ForkHistoryBranchResponse{}, nil).Maybe()
+
+	go func() {
+		_, _ = s.nDCBranchMgr.createNewBranch(ctx.Background(), []byte("some random base branch token"), 10, persistence.NewVersionHistory(nil, nil))
+	}()
+
+	select {
+	case <-s.mockShard.closeCh:
+	case <-time.After(time.Second):
+		s.Fail("watchdog did not abort the shard after the hang persisted past the abort threshold")
+	}
+}
+
+func (s *nDCBranchMgrSuite) TestWatchdogForShard_DeregistersOnShardClose() {
+	deregister := s.nDCBranchMgr.registerWatchdogOp("someOperation")
+	deregister()
+
+	s.setSkipCountFor(s.mockShard, 1)
+	_, ok := ndcBranchMgrWatchdogs[s.mockShard]
+	s.True(ok, "watchdogForShard should have registered a watchdog for the shard")
+
+	close(s.mockShard.closeCh)
+
+	require.Eventually(s.T(), func() bool {
+		ndcBranchMgrWatchdogsMu.Lock()
+		_, stillRegistered := ndcBranchMgrWatchdogs[s.mockShard]
+		ndcBranchMgrWatchdogsMu.Unlock()
+		return !stillRegistered
+	}, time.Second, time.Millisecond, "watchdog should have been deregistered after the shard closed")
+
+	ndcBranchMgrHangAlertsMu.Lock()
+	_, hasHangAlerts := ndcBranchMgrHangAlerts[s.mockShard]
+	ndcBranchMgrHangAlertsMu.Unlock()
+	s.False(hasHangAlerts, "hang alert state should have been dropped after the shard closed")
+
+	s.Equal(0, s.skipCountFor(s.mockShard), "skip budget state should have been dropped after the shard closed")
+}
+
+func (s *nDCBranchMgrSuite) TestValidateVersionHistories_Valid() {
+	versionHistory := persistence.NewVersionHistory([]byte("some random base branch token"), []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+		persistence.NewVersionHistoryItem(50, 100),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+	incomingVersionHistory := versionHistory.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Once()
+
+	err := s.nDCBranchMgr.validateVersionHistories(ctx.Background(), versionHistories, incomingVersionHistory)
+	s.NoError(err)
+}
+
+func (s *nDCBranchMgrSuite) TestValidateVersionHistories_NonMonotonicEventID() {
+	versionHistory := persistence.NewVersionHistory([]byte("some random base branch token"), []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(50, 0),
+		persistence.NewVersionHistoryItem(10, 100),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+	incomingVersionHistory := versionHistory.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Once()
+	s.mockExecutionMgr.On("PutReplicationDLQCorruptVersionHistories", mock.Anything, mock.Anything).Return(nil).Once()
+
+	err := s.nDCBranchMgr.validateVersionHistories(ctx.Background(), versionHistories, incomingVersionHistory)
+	s.Equal(ErrCorruptedVersionHistories, err)
+}
+
+func (s *nDCBranchMgrSuite) TestValidateVersionHistories_NonMonotonicVersion() {
+	versionHistory := persistence.NewVersionHistory([]byte("some random base branch token"), []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 100),
+		persistence.NewVersionHistoryItem(50, 0),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+	incomingVersionHistory := versionHistory.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Once()
+	s.mockExecutionMgr.On("PutReplicationDLQCorruptVersionHistories", mock.Anything, mock.Anything).Return(nil).Once()
+
+	err := s.nDCBranchMgr.validateVersionHistories(ctx.Background(), versionHistories, incomingVersionHistory)
+	s.Equal(ErrCorruptedVersionHistories, err)
+}
+
+func (s *nDCBranchMgrSuite) TestValidateVersionHistories_DuplicateBranchToken() {
+	sharedBranchToken := []byte("some random shared branch token")
+	firstBranch := persistence.NewVersionHistory(sharedBranchToken, []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+	})
+	secondBranch := persistence.NewVersionHistory(sharedBranchToken, []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(20, 0),
+	})
+	versionHistories := persistence.NewVersionHistories(firstBranch)
+	_, err := versionHistories.AddVersionHistory(secondBranch)
+	s.NoError(err)
+
+	incomingVersionHistory := firstBranch.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:   s.domainID,
+		WorkflowID: s.workflowID,
+		RunID:      s.runID,
+	}).Once()
+	s.mockExecutionMgr.On("PutReplicationDLQCorruptVersionHistories", mock.Anything, mock.Anything).Return(nil).Once()
+
+	err = s.nDCBranchMgr.validateVersionHistories(ctx.Background(), versionHistories, incomingVersionHistory)
+	s.Equal(ErrCorruptedVersionHistories, err)
+}
+
+func (s *nDCBranchMgrSuite) TestValidateVersionHistories_CurrentBranchBehindNextEventID() {
+	versionHistory := persistence.NewVersionHistory([]byte("some random base branch token"), []*persistence.VersionHistoryItem{
+		persistence.NewVersionHistoryItem(10, 0),
+		persistence.NewVersionHistoryItem(50, 100),
+	})
+	versionHistories := persistence.NewVersionHistories(versionHistory)
+	incomingVersionHistory := versionHistory.Duplicate()
+
+	s.mockMutableState.On("GetExecutionInfo").Return(&persistence.WorkflowExecutionInfo{
+		DomainID:    s.domainID,
+		WorkflowID:  s.workflowID,
+		RunID:       s.runID,
+		NextEventID: 1000,
+	}).Twice()
+	s.mockExecutionMgr.On("PutReplicationDLQCorruptVersionHistories", mock.Anything, mock.Anything).Return(nil).Once()
+
+	err := s.nDCBranchMgr.validateVersionHistories(ctx.Background(), versionHistories, incomingVersionHistory)
+	s.Equal(ErrCorruptedVersionHistories, err)
+}
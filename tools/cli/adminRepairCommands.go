@@ -0,0 +1,145 @@
+// Copyright (c) 2019 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package cli implements the admin CLI's "workflow repair" verb for nDC branch manager
+// corruption recovery. It relies on the CLI's usual flag-parsing helpers (getRequiredOption,
+// getRequiredIntOption, newContext, ErrorAndExit) and persistence store bootstrapping
+// (initializeExecutionStore), which live alongside the rest of tools/cli and are out of
+// scope for this change, the same way ShardContext and mutableState are for
+// service/history.
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/urfave/cli"
+
+	"github.com/uber/cadence/common/persistence"
+)
+
+const (
+	// FlagDomainID is the domain ID of the workflow being operated on.
+	FlagDomainID = "domain_id"
+	// FlagWorkflowID is the workflow ID of the workflow being operated on.
+	FlagWorkflowID = "workflow_id"
+	// FlagRunID is the run ID of the workflow being operated on.
+	FlagRunID = "run_id"
+	// FlagShardID is the shard ID the workflow being operated on belongs to.
+	FlagShardID = "shard_id"
+	// FlagVersionHistoriesFile is a JSON-encoded persistence.VersionHistories, reviewed and
+	// approved by an operator, to write in place of the corrupt record on file.
+	FlagVersionHistoriesFile = "version_histories_file"
+	// FlagYes skips the confirmation prompt, for scripted use once a DLQ entry has
+	// already been reviewed.
+	FlagYes = "yes"
+)
+
+// newAdminRepairVersionHistoriesCommand returns the `admin workflow repair` verb: it
+// rewrites a workflow's mutable state version histories to an operator-approved
+// replacement, once the replication_dlq_corrupt_histories entry
+// nDCBranchMgr.recordCorruptVersionHistories wrote for it has been reviewed.
+func newAdminRepairVersionHistoriesCommand() cli.Command {
+	return cli.Command{
+		Name:    "repair",
+		Aliases: []string{"rep"},
+		Usage:   "rewrite a workflow's version histories to an operator-approved replacement, after reviewing its corrupt-history DLQ entry",
+		Flags: []cli.Flag{
+			cli.IntFlag{Name: FlagShardID, Usage: "shard ID the workflow belongs to"},
+			cli.StringFlag{Name: FlagDomainID, Usage: "domain ID of the workflow to repair"},
+			cli.StringFlag{Name: FlagWorkflowID, Usage: "workflow ID to repair"},
+			cli.StringFlag{Name: FlagRunID, Usage: "run ID to repair"},
+			cli.StringFlag{Name: FlagVersionHistoriesFile, Usage: "path to a JSON-encoded VersionHistories, reviewed and approved by an operator, to write in place of the corrupt record"},
+			cli.BoolFlag{Name: FlagYes, Usage: "skip the confirmation prompt"},
+		},
+		Action: func(c *cli.Context) {
+			AdminRepairCorruptVersionHistories(c)
+		},
+	}
+}
+
+// AdminRepairCorruptVersionHistories reads the corrupt-history DLQ entry for the workflow
+// identified by the command's flags, prints it alongside the operator-supplied replacement
+// from FlagVersionHistoriesFile for review, asks for confirmation (skipped with --yes), and
+// unless the operator declines, rewrites the workflow's mutable state to that replacement. Replaying the DLQ entry's own
+// CorruptVersionHistories back into mutable state would be a no-op that leaves the
+// corruption in place, so a replacement that matches the corrupt record verbatim is
+// rejected rather than applied.
+func AdminRepairCorruptVersionHistories(c *cli.Context) {
+	shardID := getRequiredIntOption(c, FlagShardID)
+	executionManager := initializeExecutionStore(c, shardID)
+	domainID := getRequiredOption(c, FlagDomainID)
+	workflowID := getRequiredOption(c, FlagWorkflowID)
+	runID := getRequiredOption(c, FlagRunID)
+
+	replacementFile := getRequiredOption(c, FlagVersionHistoriesFile)
+	replacementJSON, err := ioutil.ReadFile(replacementFile)
+	if err != nil {
+		ErrorAndExit("failed to read "+FlagVersionHistoriesFile, err)
+	}
+	replacement := &persistence.VersionHistories{}
+	if err := json.Unmarshal(replacementJSON, replacement); err != nil {
+		ErrorAndExit("failed to parse "+FlagVersionHistoriesFile+" as a VersionHistories", err)
+	}
+
+	ctx := newContext(c)
+	dlqEntry, err := executionManager.GetReplicationDLQCorruptVersionHistories(ctx, &persistence.GetReplicationDLQCorruptVersionHistoriesRequest{
+		ShardID:    shardID,
+		DomainID:   domainID,
+		WorkflowID: workflowID,
+		RunID:      runID,
+	})
+	if err != nil {
+		ErrorAndExit("failed to read corrupt version histories DLQ entry", err)
+	}
+
+	if reflect.DeepEqual(dlqEntry.CorruptVersionHistories, replacement) {
+		ErrorAndExit(FlagVersionHistoriesFile+" is identical to the corrupt record on file", nil)
+	}
+
+	fmt.Printf("DLQ entry recorded: %s\n", dlqEntry.Reason)
+	fmt.Printf("corrupt version histories on record: %+v\n", dlqEntry.CorruptVersionHistories)
+	fmt.Printf("incoming version history that exposed the corruption: %+v\n", dlqEntry.IncomingVersionHistory)
+	fmt.Printf("replacement version histories from %s: %+v\n", replacementFile, replacement)
+
+	if !c.Bool(FlagYes) {
+		fmt.Print("rewrite this workflow's version histories to the replacement above? [y/N] ")
+		var confirmation string
+		fmt.Scanln(&confirmation)
+		if confirmation != "y" && confirmation != "Y" {
+			fmt.Println("aborted, no changes made")
+			return
+		}
+	}
+
+	if err := executionManager.RepairReplicationDLQCorruptVersionHistories(ctx, &persistence.RepairReplicationDLQCorruptVersionHistoriesRequest{
+		ShardID:          shardID,
+		DomainID:         domainID,
+		WorkflowID:       workflowID,
+		RunID:            runID,
+		VersionHistories: replacement,
+	}); err != nil {
+		ErrorAndExit("failed to repair version histories", err)
+	}
+
+	fmt.Println("version histories repaired")
+}